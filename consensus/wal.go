@@ -1,9 +1,14 @@
 package consensus
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	wire "github.com/tendermint/go-wire"
@@ -12,6 +17,17 @@ import (
 	cmn "github.com/tendermint/tmlibs/common"
 )
 
+// maxConsensusMsgSize is the largest encoded consensus message (proposal,
+// vote, or block part) the WAL should ever need to carry.
+const maxConsensusMsgSize = 1048576 // 1MB
+
+// maxMsgSizeBytes is the largest encoded TimedWALMessage that WAL.Save will
+// write and that WALDecoder.Decode will accept: the largest consensus
+// message plus the amino/wire framing and time.Time overhead that wrap it in
+// a TimedWALMessage. Anything bigger on the read side is treated as a
+// corrupt length header rather than an allocation request.
+const maxMsgSizeBytes = maxConsensusMsgSize + 24 // amino/wire + time.Time overhead
+
 //--------------------------------------------------------
 // types and functions for savings consensus messages
 
@@ -20,6 +36,13 @@ type TimedWALMessage struct {
 	Msg  WALMessage `json:"msg"`
 }
 
+// EndHeightMessage marks the end of a consensus height in the WAL. It lets a
+// reader walk a WAL file with a single framed-message decoder instead of
+// sniffing for a raw string in between TimedWALMessages.
+type EndHeightMessage struct {
+	Height int64 `json:"height"`
+}
+
 type WALMessage interface{}
 
 var _ = wire.RegisterInterface(
@@ -27,8 +50,65 @@ var _ = wire.RegisterInterface(
 	wire.ConcreteType{types.EventDataRoundState{}, 0x01},
 	wire.ConcreteType{msgInfo{}, 0x02},
 	wire.ConcreteType{timeoutInfo{}, 0x03},
+	wire.ConcreteType{EndHeightMessage{}, 0x04},
 )
 
+// endHeightPrefix is how legacy WAL files (written before EndHeightMessage
+// was introduced) mark the end of a height: a bare "#ENDHEIGHT: <n>" line
+// instead of a framed TimedWALMessage.
+var endHeightPrefix = []byte("#ENDHEIGHT: ")
+
+// decodeEndHeightCompat recognizes a legacy "#ENDHEIGHT: <n>" record and
+// turns it into the TimedWALMessage/EndHeightMessage a reader would get from
+// a freshly written WAL, so old and new WAL files can be read the same way.
+// ok is false when msg isn't a legacy record at all.
+func decodeEndHeightCompat(msg []byte) (twm TimedWALMessage, ok bool, err error) {
+	if !bytes.HasPrefix(msg, endHeightPrefix) {
+		return TimedWALMessage{}, false, nil
+	}
+	height, err := strconv.ParseInt(string(msg[len(endHeightPrefix):]), 10, 64)
+	if err != nil {
+		return TimedWALMessage{}, true, fmt.Errorf("failed to parse legacy #ENDHEIGHT line: %v", err)
+	}
+	return TimedWALMessage{Msg: EndHeightMessage{Height: height}}, true, nil
+}
+
+// walDefaultFlushInterval is how often the background flush loop calls
+// group.Flush() when the WAL isn't given a NewWAL option overriding it.
+const walDefaultFlushInterval = 2 * time.Second
+
+// WALOption overrides a default WAL setting. Pass to NewWAL.
+type WALOption func(*WAL)
+
+// WALFlushInterval overrides the default interval at which the WAL's
+// background goroutine flushes the underlying group to disk.
+func WALFlushInterval(flushInterval time.Duration) WALOption {
+	return func(wal *WAL) { wal.flushInterval = flushInterval }
+}
+
+// WALMaxHeadBytes bounds how large the group's head file may grow before
+// it's rotated into a new chunk.
+func WALMaxHeadBytes(maxHeadBytes int64) WALOption {
+	return func(wal *WAL) { wal.group.HeadSizeLimit = maxHeadBytes }
+}
+
+// WALTotalSizeLimit bounds the total size of rotated chunks the group is
+// allowed to retain on its own, independent of MinHeightRetained.
+func WALTotalSizeLimit(totalSizeLimit int64) WALOption {
+	return func(wal *WAL) { wal.group.TotalSizeLimit = totalSizeLimit }
+}
+
+// WALMinHeightRetained enables the background pruner and sets how many
+// heights it retains behind the last height written: on each tick it calls
+// Prune with the height of the last EndHeightMessage written minus
+// minHeightRetained.
+func WALMinHeightRetained(minHeightRetained int64) WALOption {
+	return func(wal *WAL) {
+		wal.minHeightRetained = minHeightRetained
+		wal.pruneInterval = walDefaultFlushInterval
+	}
+}
+
 //--------------------------------------------------------
 // Simple write-ahead logger
 
@@ -41,16 +121,36 @@ type WAL struct {
 
 	group *auto.Group
 	light bool // ignore block parts
+
+	flushInterval time.Duration
+	flushTicker   *time.Ticker
+	flushDone     chan struct{}
+	flushStopped  chan struct{} // closed once flushRoutine has returned
+
+	minHeightRetained int64 // 0 disables height-based pruning
+	pruneInterval     time.Duration
+	pruneTicker       *time.Ticker
+	pruneDone         chan struct{}
+	pruneStopped      chan struct{} // closed once pruneRoutine has returned
+	lastHeight        int64         // height of the last EndHeightMessage written
+
+	readersMu sync.Mutex
+	readers   map[int]int // chunk index -> number of open readers, guards Prune against deleting a chunk in use
 }
 
-func NewWAL(walFile string, light bool) (*WAL, error) {
+func NewWAL(walFile string, light bool, options ...WALOption) (*WAL, error) {
 	group, err := auto.OpenGroup(walFile)
 	if err != nil {
 		return nil, err
 	}
 	wal := &WAL{
-		group: group,
-		light: light,
+		group:         group,
+		light:         light,
+		flushInterval: walDefaultFlushInterval,
+		readers:       make(map[int]int),
+	}
+	for _, option := range options {
+		option(wal)
 	}
 	wal.BaseService = *cmn.NewBaseService(nil, "WAL", wal)
 	return wal, nil
@@ -63,44 +163,235 @@ func (wal *WAL) OnStart() error {
 	} else if size == 0 {
 		wal.writeEndHeight(0)
 	}
-	_, err = wal.group.Start()
-	return err
+	if _, err := wal.group.Start(); err != nil {
+		return err
+	}
+
+	wal.flushTicker = time.NewTicker(wal.flushInterval)
+	wal.flushDone = make(chan struct{})
+	wal.flushStopped = make(chan struct{})
+	go wal.flushRoutine()
+
+	if wal.minHeightRetained > 0 {
+		wal.pruneTicker = time.NewTicker(wal.pruneInterval)
+		wal.pruneDone = make(chan struct{})
+		wal.pruneStopped = make(chan struct{})
+		go wal.pruneRoutine()
+	}
+	return nil
 }
 
 func (wal *WAL) OnStop() {
 	wal.BaseService.OnStop()
+	wal.flushTicker.Stop()
+	close(wal.flushDone)
+	<-wal.flushStopped // wait for flushRoutine to exit before it's safe to stop the group
+	if wal.pruneTicker != nil {
+		wal.pruneTicker.Stop()
+		close(wal.pruneDone)
+		<-wal.pruneStopped // wait for pruneRoutine to exit before it's safe to stop the group
+	}
 	wal.group.Stop()
 }
 
+// flushRoutine periodically flushes the WAL to disk so that Save doesn't pay
+// for a sync on every message. Critical checkpoints that can't wait for the
+// next tick should call FlushAndSync directly instead.
+func (wal *WAL) flushRoutine() {
+	defer close(wal.flushStopped)
+	for {
+		select {
+		case <-wal.flushTicker.C:
+			if err := wal.FlushAndSync(); err != nil {
+				wal.Logger.Error("Periodic WAL flush failed", "err", err)
+			}
+		case <-wal.flushDone:
+			return
+		}
+	}
+}
+
+// FlushAndSync flushes the underlying group to disk immediately. Within the
+// WAL it's called by flushRoutine on every tick and by writeEndHeight after
+// each height marker; the consensus reactor doesn't call it, so votes and
+// other messages saved mid-height wait for the next periodic flush.
+func (wal *WAL) FlushAndSync() error {
+	return wal.group.Flush()
+}
+
+// pruneRoutine periodically prunes chunks for heights more than
+// minHeightRetained below the last height written.
+func (wal *WAL) pruneRoutine() {
+	defer close(wal.pruneStopped)
+	for {
+		select {
+		case <-wal.pruneTicker.C:
+			keepFromHeight := atomic.LoadInt64(&wal.lastHeight) - wal.minHeightRetained
+			if err := wal.Prune(keepFromHeight); err != nil {
+				wal.Logger.Error("Periodic WAL prune failed", "err", err)
+			}
+		case <-wal.pruneDone:
+			return
+		}
+	}
+}
+
+// Prune removes rotated chunks that come before the EndHeightMessage for
+// keepFromHeight, i.e. chunks at and after the first one carrying an
+// EndHeightMessage for a height >= keepFromHeight are kept, and everything
+// before that point (including any marker-less chunks that rotated
+// mid-height, and any messages of height keepFromHeight itself recorded in
+// those earlier chunks) is deleted together. It never inspects or deletes the head chunk (the one still
+// being written to), so it can't race a SearchForEndHeight that's reading
+// from a chunk still in flight.
+func (wal *WAL) Prune(keepFromHeight int64) error {
+	if keepFromHeight <= 0 {
+		return nil
+	}
+
+	min, max := wal.group.MinIndex(), wal.group.MaxIndex()
+
+	// Scan forward for the first chunk that's still needed: the one whose
+	// own EndHeightMessage is already at or past keepFromHeight. A chunk
+	// with no marker of its own just means the height it belongs to rotated
+	// mid-write and ends in a later chunk, so keep scanning past it instead
+	// of stopping there.
+	cutoff := max
+	for index := min; index < max; index++ {
+		height, found, err := wal.lastEndHeightIn(index)
+		if err != nil {
+			return err
+		}
+		if found && height >= keepFromHeight {
+			cutoff = index
+			break
+		}
+	}
+
+	for index := min; index < cutoff; index++ {
+		deleted, err := wal.deleteChunkIfUnused(index)
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			// A replay in progress is reading this chunk; stop here and
+			// let the next prune tick pick up where we left off.
+			break
+		}
+	}
+	return nil
+}
+
+// openReader wraps group.NewReader(index), recording that index has an open
+// reader so Prune won't delete the chunk out from under it. Callers must
+// pass the returned reader to closeReader instead of closing it directly.
+func (wal *WAL) openReader(index int) (*auto.GroupReader, error) {
+	gr, err := wal.group.NewReader(index)
+	if err != nil {
+		return nil, err
+	}
+	wal.readersMu.Lock()
+	wal.readers[index]++
+	wal.readersMu.Unlock()
+	return gr, nil
+}
+
+// closeReader closes gr and releases the hold openReader placed on index.
+func (wal *WAL) closeReader(index int, gr *auto.GroupReader) error {
+	err := gr.Close()
+	wal.readersMu.Lock()
+	wal.readers[index]--
+	if wal.readers[index] <= 0 {
+		delete(wal.readers, index)
+	}
+	wal.readersMu.Unlock()
+	return err
+}
+
+// deleteChunkIfUnused deletes the chunk at index unless a reader opened via
+// openReader is currently reading it, in which case it leaves the chunk
+// alone and returns deleted=false. The in-use check and the delete happen
+// under the same lock as openReader/closeReader's refcount updates, so a
+// reader can't acquire a lease on index in the gap between the check and the
+// delete.
+func (wal *WAL) deleteChunkIfUnused(index int) (deleted bool, err error) {
+	wal.readersMu.Lock()
+	defer wal.readersMu.Unlock()
+	if wal.readers[index] > 0 {
+		return false, nil
+	}
+	if err := wal.group.DeleteIndex(index); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// lastEndHeightIn returns the height of the last EndHeightMessage found in
+// the chunk at index. found is false if the chunk has no EndHeightMessage at
+// all. Corrupt records are skipped so a single bad record can't pin the
+// whole chunk from pruning.
+func (wal *WAL) lastEndHeightIn(index int) (height int64, found bool, err error) {
+	gr, err := wal.openReader(index)
+	if err != nil {
+		return 0, false, err
+	}
+	defer wal.closeReader(index, gr)
+
+	dec := NewWALDecoder(gr)
+	for {
+		msg, err := dec.Decode()
+		if err == io.EOF {
+			return height, found, nil
+		}
+		if _, ok := err.(DataCorruptionError); ok {
+			continue
+		}
+		if err != nil {
+			return height, found, err
+		}
+		if m, ok := msg.Msg.(EndHeightMessage); ok {
+			height, found = m.Height, true
+		}
+	}
+}
+
 // called in newStep and for each pass in receiveRoutine
-func (wal *WAL) Save(wmsg WALMessage) {
+func (wal *WAL) Save(wmsg WALMessage) error {
 	if wal == nil {
-		return
+		return nil
 	}
 
 	if wal.light {
 		// in light mode we only write new steps, timeouts, and our own votes (no proposals, block parts)
 		if mi, ok := wmsg.(msgInfo); ok {
 			if mi.PeerKey != "" {
-				return
+				return nil
 			}
 		}
 	}
 
-	// Write the wal message
-	wal.save(wire.BinaryBytes(TimedWALMessage{time.Now(), wmsg}))
-
-	// TODO: only flush when necessary
-	if err := wal.group.Flush(); err != nil {
-		cmn.PanicQ(cmn.Fmt("Error flushing consensus wal buf to file. Error: %v \n", err))
+	data := wire.BinaryBytes(TimedWALMessage{time.Now(), wmsg})
+	if len(data) > maxMsgSizeBytes {
+		return fmt.Errorf("msg is too big: %d bytes, max %d bytes", len(data), maxMsgSizeBytes)
 	}
+
+	// Write the wal message. Flushing is handled by flushRoutine, except
+	// after writeEndHeight, which calls FlushAndSync itself.
+	wal.save(data)
+	return nil
 }
 
 func (wal *WAL) writeEndHeight(height int) {
-	wal.save([]byte(fmt.Sprintf("#ENDHEIGHT: %v", height)))
+	wal.save(wire.BinaryBytes(TimedWALMessage{
+		Time: time.Now(),
+		Msg:  EndHeightMessage{Height: int64(height)},
+	}))
+	atomic.StoreInt64(&wal.lastHeight, int64(height))
 
-	// TODO: only flush when necessary
-	if err := wal.group.Flush(); err != nil {
+	// Flush and sync immediately: we don't want to lose the marker for the
+	// height we just finished if the process crashes before the next
+	// periodic flush.
+	if err := wal.FlushAndSync(); err != nil {
 		cmn.PanicQ(cmn.Fmt("Error flushing consensus wal buf to file. Error: %v \n", err))
 	}
 }
@@ -125,3 +416,141 @@ func (wal *WAL) save(msg []byte) {
 		cmn.PanicQ(cmn.Fmt("Error writing msg to consensus wal: wanted to write %d bytes, but wrote %d \n\nMessage: %v", totalLength, n, msg))
 	}
 }
+
+// WALSearchOptions are optional arguments to SearchForEndHeight.
+type WALSearchOptions struct {
+	// IgnoreDataCorruptionErrors set to true skips over corrupt records
+	// instead of aborting the search, for best-effort recovery.
+	IgnoreDataCorruptionErrors bool
+}
+
+// SearchForEndHeight searches the WAL, newest chunk first, for the
+// EndHeightMessage marking the given height. On success it returns an
+// io.ReadCloser positioned right after that message, so the consensus state
+// can replay everything recorded since. found is false if height isn't in
+// the WAL at all.
+//
+// The returned reader holds a lease (see openReader) on its chunk for as
+// long as it stays open, so Prune can't delete that chunk while a search or
+// replay is still reading from it; the caller must Close it when done to
+// release the lease.
+func (wal *WAL) SearchForEndHeight(height int64, options *WALSearchOptions) (rd io.ReadCloser, found bool, err error) {
+	var msg *TimedWALMessage
+
+	min, max := wal.group.MinIndex(), wal.group.MaxIndex()
+	for index := max; index >= min; index-- {
+		gr, err := wal.openReader(index)
+		if err != nil {
+			return nil, false, err
+		}
+
+		dec := NewWALDecoder(gr)
+		for {
+			msg, err = dec.Decode()
+			if err == io.EOF {
+				// no more records in this chunk; try the previous one
+				break
+			}
+			if err != nil {
+				if _, ok := err.(DataCorruptionError); ok && options != nil && options.IgnoreDataCorruptionErrors {
+					continue
+				}
+				wal.closeReader(index, gr)
+				return nil, false, err
+			}
+
+			if m, ok := msg.Msg.(EndHeightMessage); ok && m.Height == height {
+				return &leasedReader{GroupReader: gr, wal: wal, index: index}, true, nil
+			}
+		}
+		wal.closeReader(index, gr)
+	}
+	return nil, false, nil
+}
+
+// leasedReader wraps the *auto.GroupReader returned to a SearchForEndHeight
+// caller so that Close both closes the reader and releases the openReader
+// hold on its chunk, keeping the chunk eligible for Prune again.
+type leasedReader struct {
+	*auto.GroupReader
+	wal   *WAL
+	index int
+}
+
+func (lr *leasedReader) Close() error {
+	return lr.wal.closeReader(lr.index, lr.GroupReader)
+}
+
+// DataCorruptionError is returned by WALDecoder.Decode when a record fails
+// its checksum, exceeds maxMsgSizeBytes, or otherwise can't be trusted as a
+// valid frame.
+type DataCorruptionError struct {
+	cause error
+}
+
+func (e DataCorruptionError) Error() string {
+	return fmt.Sprintf("DataCorruptionError: %v", e.cause)
+}
+
+// Cause returns the underlying error that triggered the corruption.
+func (e DataCorruptionError) Cause() error {
+	return e.cause
+}
+
+// WALDecoder decodes custom-encoded WAL records: a 4-byte CRC32, a 4-byte
+// length, and the amino/wire-encoded TimedWALMessage payload.
+type WALDecoder struct {
+	rd io.Reader
+}
+
+// NewWALDecoder returns a decoder that reads records from rd.
+func NewWALDecoder(rd io.Reader) *WALDecoder {
+	return &WALDecoder{rd}
+}
+
+// Decode reads, validates and decodes the next record. It returns io.EOF
+// once rd is cleanly exhausted between records, and a DataCorruptionError if
+// the record's checksum doesn't match, its declared length exceeds
+// maxMsgSizeBytes, or the record is truncated (e.g. a process crashed
+// mid-write, leaving a partial trailing record).
+func (dec *WALDecoder) Decode() (*TimedWALMessage, error) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(dec.rd, header)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, DataCorruptionError{fmt.Errorf("failed to read checksum and length: %v", err)}
+	}
+	crc := binary.BigEndian.Uint32(header[0:4])
+	length := binary.BigEndian.Uint32(header[4:8])
+
+	if length > maxMsgSizeBytes {
+		return nil, DataCorruptionError{fmt.Errorf("length %d exceeds maximum possible value of %d bytes", length, maxMsgSizeBytes)}
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(dec.rd, data); err != nil {
+		return nil, DataCorruptionError{fmt.Errorf("failed to read message: %v", err)}
+	}
+
+	actualCRC := crc32.Checksum(data, crc32c)
+	if actualCRC != crc {
+		return nil, DataCorruptionError{fmt.Errorf("checksums do not match: read %v, actual %v", crc, actualCRC)}
+	}
+
+	if twm, ok, err := decodeEndHeightCompat(data); ok {
+		if err != nil {
+			return nil, DataCorruptionError{err}
+		}
+		return &twm, nil
+	}
+
+	var twm TimedWALMessage
+	var n int
+	wire.ReadBinaryPtr(&twm, bytes.NewBuffer(data), 0, &n, &err)
+	if err != nil {
+		return nil, DataCorruptionError{fmt.Errorf("failed to decode data: %v", err)}
+	}
+	return &twm, nil
+}